@@ -0,0 +1,28 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package config
+
+// FolderConfiguration holds the per-folder options that change scan and
+// pull behavior for that folder. The full configuration (versioning,
+// ignore patterns, devices, ...) isn't part of this tree; this is the
+// subset the Windows attribute work needs.
+type FolderConfiguration struct {
+	ID string
+
+	// SyncWindowsAttributes enables recording Windows file attributes
+	// (READONLY, HIDDEN, SYSTEM, ...) at scan time and reapplying them in
+	// the puller, so e.g. a HIDDEN file stays HIDDEN on every replica.
+	// Off by default: it's a behavior change existing folders shouldn't
+	// pick up silently on upgrade.
+	SyncWindowsAttributes bool
+}
+
+// NewFolderConfiguration returns a FolderConfiguration with the defaults
+// for a newly added folder.
+func NewFolderConfiguration(id string) FolderConfiguration {
+	return FolderConfiguration{ID: id}
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2018 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package fs
+
+import (
+	"context"
+	"fmt"
+)
+
+// WatchUSN is the Windows-specific alternative to the regular
+// ReadDirectoryChangesW-based Watch: when the folder's root lives on an
+// NTFS volume, it replays and follows the volume's USN Journal instead,
+// so changes made while Syncthing wasn't running aren't missed. It isn't
+// behind a per-folder option of its own: the model's startWatch tries it
+// first for every watched folder. Callers should fall back to the
+// regular Watch when the returned error is non-nil, e.g. because the
+// volume isn't NTFS.
+//
+// stateDir is where the last-processed USN is persisted across restarts;
+// callers should pass the folder's marker directory.
+func (f *BasicFilesystem) WatchUSN(ctx context.Context, stateDir string) (<-chan Event, <-chan error, error) {
+	root, err := f.rooted("")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state, err := newFileUSNState(stateDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("usn: opening state store: %w", err)
+	}
+
+	w, err := newUSNWatcher(root, state)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	events := make(chan Event)
+	errs := make(chan error, 1)
+	stop := make(chan struct{})
+
+	go func() {
+		<-ctx.Done()
+		close(stop)
+	}()
+
+	go func() {
+		defer w.Close()
+		defer close(events)
+		if err := w.Watch(stop, events, func() {
+			// A full rescan is requested by sending a single Event for
+			// the folder root; the regular scanner walk already treats
+			// that as "rescan everything under this path".
+			select {
+			case events <- Event{Name: ".", Type: NonRemove}:
+			case <-stop:
+			}
+		}); err != nil {
+			errs <- err
+		}
+	}()
+
+	return events, errs, nil
+}
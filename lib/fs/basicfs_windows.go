@@ -10,32 +10,264 @@ package fs
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"golang.org/x/sys/windows"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"unsafe"
 )
 
-var errNotSupported = errors.New("symlinks not supported")
+// symbolicLinkFlagAllowUnprivilegedCreate lets CreateSymbolicLinkW succeed
+// without the SeCreateSymbolicLinkPrivilege when the process token was
+// obtained with Developer Mode enabled (Windows 10 1703+). Not yet exposed
+// as a named constant in golang.org/x/sys/windows at the time of writing.
+const symbolicLinkFlagAllowUnprivilegedCreate = 0x2
+
+const (
+	fileFlagOpenReparsePoint = 0x00200000
+	fileFlagBackupSemantics  = 0x02000000
+	fsctlGetReparsePoint     = 0x000900A8
+	reparseDataBufferSize    = 16 * 1024 // maximum allowed by the kernel
+
+	reparseTagSymlink    = 0xA000000C
+	reparseTagMountPoint = 0xA0000003
+)
+
+// symlinksSupported caches the result of probing whether this process can
+// create symbolic links (either because it's elevated, or because
+// Developer Mode is enabled and the unprivileged-create flag works).
+var (
+	symlinksSupportedOnce sync.Once
+	symlinksSupportedBool bool
+)
 
 func (BasicFilesystem) SymlinksSupported() bool {
-	return false
+	symlinksSupportedOnce.Do(func() {
+		symlinksSupportedBool = probeSymlinkSupport()
+	})
+	return symlinksSupportedBool
 }
 
-func (BasicFilesystem) ReadSymlink(path string) (string, error) {
-	return "", errNotSupported
+// probeSymlinkSupport attempts to create and immediately remove a symlink
+// in the temp directory, to find out whether the current process/token is
+// able to create symlinks at all. This covers both "running elevated" and
+// "Developer Mode enabled" without requiring the caller to know which.
+func probeSymlinkSupport() bool {
+	dir, err := ioutil.TempDir("", "syncthing-symlink-probe-")
+	if err != nil {
+		return false
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	if err := ioutil.WriteFile(target, nil, 0644); err != nil {
+		return false
+	}
+	link := filepath.Join(dir, "link")
+
+	return createSymlink(target, link, false) == nil
 }
 
-func (BasicFilesystem) CreateSymlink(target, name string) error {
-	return errNotSupported
+// createSymlink creates a Windows symbolic link at name, pointing at
+// target. isDir indicates whether the link should be created as a
+// directory symlink (Windows distinguishes the two at creation time).
+func createSymlink(target, name string, isDir bool) error {
+	targetp, err := syscall.UTF16PtrFromString(target)
+	if err != nil {
+		return err
+	}
+	namep, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	var flags uint32 = symbolicLinkFlagAllowUnprivilegedCreate
+	if isDir {
+		flags |= windows.SYMBOLIC_LINK_FLAG_DIRECTORY
+	}
+
+	r1, _, e1 := syscall.Syscall6(procCreateSymbolicLinkW.Addr(), 3,
+		uintptr(unsafe.Pointer(namep)), uintptr(unsafe.Pointer(targetp)), uintptr(flags), 0, 0, 0)
+	if r1 == 0 {
+		if e1 != 0 {
+			return error(e1)
+		}
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+var (
+	modkernel32             = syscall.NewLazyDLL("kernel32.dll")
+	procCreateSymbolicLinkW = modkernel32.NewProc("CreateSymbolicLinkW")
+)
+
+// reparseDataBuffer mirrors the kernel's REPARSE_DATA_BUFFER, laid out for
+// the two tags we care about (symlinks and junctions/mount points); see
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/ab262e3d-3a77-4dfc-8c12-771e00937af5
+type reparseDataBuffer struct {
+	ReparseTag        uint32
+	ReparseDataLength uint16
+	Reserved          uint16
+
+	// SymbolicLinkReparseBuffer / MountPointReparseBuffer share this shape.
+	SubstituteNameOffset uint16
+	SubstituteNameLength uint16
+	PrintNameOffset      uint16
+	PrintNameLength      uint16
+	// Flags is only present for IO_REPARSE_TAG_SYMLINK; absent (and the
+	// path buffer starts 4 bytes earlier) for IO_REPARSE_TAG_MOUNT_POINT.
+	Flags      uint32
+	PathBuffer [1]uint16
+}
+
+func (f *BasicFilesystem) ReadSymlink(name string) (string, error) {
+	name, err := f.rooted(name)
+	if err != nil {
+		return "", err
+	}
+	name = fixLongPath(name)
+
+	namep, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return "", err
+	}
+
+	h, err := syscall.CreateFile(namep, 0, 0, nil, syscall.OPEN_EXISTING,
+		fileFlagOpenReparsePoint|fileFlagBackupSemantics, 0)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.CloseHandle(h)
+
+	buf := make([]byte, reparseDataBufferSize)
+	var bytesReturned uint32
+	err = syscall.DeviceIoControl(h, fsctlGetReparsePoint, nil, 0, &buf[0], uint32(len(buf)), &bytesReturned, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return parseReparseTarget(buf)
+}
+
+// parseReparseTarget extracts the print name from a REPARSE_DATA_BUFFER
+// for either IO_REPARSE_TAG_SYMLINK or IO_REPARSE_TAG_MOUNT_POINT
+// (junction), pulled out of ReadSymlink so the offset arithmetic can be
+// unit tested against a synthetic buffer without a real reparse point.
+func parseReparseTarget(buf []byte) (string, error) {
+	rdb := (*reparseDataBuffer)(unsafe.Pointer(&buf[0]))
+	switch rdb.ReparseTag {
+	case reparseTagSymlink, reparseTagMountPoint:
+		// IO_REPARSE_TAG_MOUNT_POINT's MountPointReparseBuffer has no
+		// Flags field, so its path buffer starts 4 bytes earlier than
+		// IO_REPARSE_TAG_SYMLINK's SymbolicLinkReparseBuffer - reading
+		// junctions through the symlink offset skips into the name
+		// buffer and returns garbage.
+		pathBufOffset := unsafe.Offsetof(rdb.PathBuffer)
+		if rdb.ReparseTag == reparseTagMountPoint {
+			pathBufOffset -= unsafe.Sizeof(rdb.Flags)
+		}
+		printName := bufToUTF16(buf, int(pathBufOffset)+int(rdb.PrintNameOffset), int(rdb.PrintNameLength))
+		target := syscall.UTF16ToString(printName)
+		target = strings.TrimPrefix(target, `\??\`)
+		return target, nil
+	default:
+		return "", fmt.Errorf("unsupported reparse tag %#x", rdb.ReparseTag)
+	}
+}
+
+func bufToUTF16(buf []byte, byteOffset, byteLength int) []uint16 {
+	n := byteLength / 2
+	out := make([]uint16, n)
+	for i := 0; i < n; i++ {
+		out[i] = uint16(buf[byteOffset+2*i]) | uint16(buf[byteOffset+2*i+1])<<8
+	}
+	return out
+}
+
+func (f *BasicFilesystem) CreateSymlink(target, name string) error {
+	dest, err := f.rooted(name)
+	if err != nil {
+		return err
+	}
+	dest = fixLongPath(dest)
+
+	// The target is resolved relative to name's parent directory, same as
+	// any other symlink; stat it to decide whether to create a file or
+	// directory link, as Windows requires the distinction up front.
+	absTarget := target
+	if !filepath.IsAbs(absTarget) {
+		absTarget = filepath.Join(filepath.Dir(dest), target)
+	}
+	isDir := false
+	if info, err := os.Stat(absTarget); err == nil {
+		isDir = info.IsDir()
+	}
+
+	return createSymlink(target, dest, isDir)
+}
+
+// longPathPrefix is prepended to absolute paths that are too long for the
+// regular Win32 file APIs, switching them to the "extended-length" form
+// which bypasses MAX_PATH and disables the usual `.`/`..` and `/` handling.
+const longPathPrefix = `\\?\`
+const longPathUNCPrefix = `\\?\UNC\`
+
+// maxShortPath is the threshold above which we switch a path to its
+// extended-length form. It's kept comfortably below the 260 character
+// MAX_PATH limit to leave room for the API's own null terminator and any
+// short relative additions (e.g. ".tmp" suffixes) made downstream.
+const maxShortPath = 248
+
+// fixLongPath returns path in its extended-length ("\\?\") form when path
+// is absolute and long enough that the regular Win32 file APIs would
+// reject it. Relative paths, and paths that already use one of the
+// extended-length prefixes, are returned unchanged. See
+// https://docs.microsoft.com/en-us/windows/win32/fileio/naming-a-file#maximum-path-length-limitation
+func fixLongPath(absPath string) string {
+	if len(absPath) < maxShortPath {
+		return absPath
+	}
+
+	if !filepath.IsAbs(absPath) {
+		// We can't turn a relative path into an extended-length one, as
+		// those are always interpreted relative to the current
+		// directory, never subject to the usual lookup rules.
+		return absPath
+	}
+
+	if strings.HasPrefix(absPath, `\\?\`) || strings.HasPrefix(absPath, `\??\`) {
+		// Already in extended-length (or NT native) form.
+		return absPath
+	}
+
+	// The extended-length prefix disables the usual backslash/forward
+	// slash and `.`/`..` handling, so we have to do it ourselves first.
+	absPath = filepath.Clean(strings.Replace(absPath, "/", `\`, -1))
+
+	if strings.HasPrefix(absPath, `\\`) {
+		// UNC path: \\server\share\... becomes \\?\UNC\server\share\...
+		return longPathUNCPrefix + absPath[2:]
+	}
+
+	if len(absPath) >= 2 && absPath[1] == ':' {
+		// Drive letter path: C:\... becomes \\?\C:\...
+		return longPathPrefix + absPath
+	}
+
+	// Doesn't look like an absolute path we know how to handle (e.g. no
+	// drive letter); leave it as-is rather than risk breaking it.
+	return absPath
 }
 
 // Required due to https://github.com/golang/go/issues/10900
 func (f *BasicFilesystem) mkdirAll(path string, perm os.FileMode) error {
+	path = fixLongPath(path)
+
 	// Fast path: if we can tell whether path is a directory or file, stop with success or error.
 	dir, err := os.Stat(path)
 	if err == nil {
@@ -90,6 +322,7 @@ func (f *BasicFilesystem) Unhide(name string) error {
 	if err != nil {
 		return err
 	}
+	name = fixLongPath(name)
 	p, err := syscall.UTF16PtrFromString(name)
 	if err != nil {
 		return err
@@ -109,6 +342,7 @@ func (f *BasicFilesystem) Hide(name string) error {
 	if err != nil {
 		return err
 	}
+	name = fixLongPath(name)
 	p, err := syscall.UTF16PtrFromString(name)
 	if err != nil {
 		return err
@@ -129,6 +363,7 @@ func (f *BasicFilesystem) SetFileAttributes(name string, attrs uint32) error {
 	if err != nil {
 		return err
 	}
+	name = fixLongPath(name)
 
 	p, err := syscall.UTF16PtrFromString(name)
 	if err != nil {
@@ -143,6 +378,7 @@ func (f *BasicFilesystem) GetFileAttributes(name string) (uint32, error) {
 	if err != nil {
 		return 0, err
 	}
+	name = fixLongPath(name)
 	p, err := syscall.UTF16PtrFromString(name)
 	if err != nil {
 		return 0, err
@@ -151,12 +387,30 @@ func (f *BasicFilesystem) GetFileAttributes(name string) (uint32, error) {
 	return syscall.GetFileAttributes(p)
 }
 
-// Currently only 3 file attributes are allowed: hidden, system, not_content_indexed
+// syncableFileAttributes is the set of attributes we consider part of a
+// file's synced metadata. It deliberately excludes DIRECTORY, COMPRESSED,
+// ENCRYPTED, REPARSE_POINT and similar, which are either derived by the
+// filesystem or have semantics (encryption, compression) syncing the bit
+// alone can't reproduce.
+//
+// TODO: go 1.11: use windows.FILE_ATTRIBUTE_NOT_CONTENT_INDEXED instead of 0x00002000
+const syncableFileAttributes = windows.FILE_ATTRIBUTE_HIDDEN |
+	windows.FILE_ATTRIBUTE_SYSTEM |
+	windows.FILE_ATTRIBUTE_READONLY |
+	windows.FILE_ATTRIBUTE_ARCHIVE |
+	windows.FILE_ATTRIBUTE_TEMPORARY |
+	windows.FILE_ATTRIBUTE_OFFLINE |
+	0x00002000 // FILE_ATTRIBUTE_NOT_CONTENT_INDEXED
+
+// AddFileAttributes sets the bits in newAttrs on name, leaving any other
+// attribute untouched. Only the attributes in syncableFileAttributes are
+// honored; anything else in newAttrs is silently ignored.
 func (f *BasicFilesystem) AddFileAttributes(name string, newAttrs uint32) error {
 	name, err := f.rooted(name)
 	if err != nil {
 		return err
 	}
+	name = fixLongPath(name)
 
 	p, err := syscall.UTF16PtrFromString(name)
 	if err != nil {
@@ -168,11 +422,34 @@ func (f *BasicFilesystem) AddFileAttributes(name string, newAttrs uint32) error
 		return err
 	}
 
-	// TODO: go 1.11: use windows.FILE_ATTRIBUTE_NOT_CONTENT_INDEXED instead of 0x00002000
-	newAttrs &= windows.FILE_ATTRIBUTE_HIDDEN | windows.FILE_ATTRIBUTE_SYSTEM | 0x00002000
+	newAttrs &= syncableFileAttributes
 	return syscall.SetFileAttributes(p, attrs|newAttrs)
 }
 
+// RemoveFileAttributes clears the bits in oldAttrs on name, leaving any
+// other attribute untouched. Only the attributes in syncableFileAttributes
+// are honored; anything else in oldAttrs is silently ignored.
+func (f *BasicFilesystem) RemoveFileAttributes(name string, oldAttrs uint32) error {
+	name, err := f.rooted(name)
+	if err != nil {
+		return err
+	}
+	name = fixLongPath(name)
+
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := syscall.GetFileAttributes(p)
+	if err != nil {
+		return err
+	}
+
+	oldAttrs &= syncableFileAttributes
+	return syscall.SetFileAttributes(p, attrs&^oldAttrs)
+}
+
 func (f *BasicFilesystem) Roots() ([]string, error) {
 	kernel32, err := syscall.LoadDLL("kernel32.dll")
 	if err != nil {
@@ -207,7 +484,7 @@ func (f *BasicFilesystem) resolveWin83(absPath string) string {
 	if !isMaybeWin83(absPath) {
 		return absPath
 	}
-	if in, err := syscall.UTF16FromString(absPath); err == nil {
+	if in, err := syscall.UTF16FromString(fixLongPath(absPath)); err == nil {
 		out := make([]uint16, 4*len(absPath)) // *2 for UTF16 and *2 to double path length
 		if n, err := syscall.GetLongPathName(&in[0], &out[0], uint32(len(out))); err == nil {
 			if n <= uint32(len(out)) {
@@ -238,3 +515,205 @@ func isMaybeWin83(absPath string) bool {
 	}
 	return strings.Contains(strings.TrimPrefix(filepath.Base(absPath), WindowsTempPrefix), "~")
 }
+
+// maxSymlinkHops matches the kernel's own limit on how many reparse
+// points it will transparently follow while resolving a single path
+// (see the NTFS/IFS documentation for IO_REPARSE_TAG_SYMLINK); we apply
+// the same bound ourselves since we resolve hops manually below.
+const maxSymlinkHops = 40
+
+// fileAttributeTagInfo mirrors FILE_ATTRIBUTE_TAG_INFO, as returned by
+// GetFileInformationByHandleEx(FileAttributeTagInfo).
+type fileAttributeTagInfo struct {
+	FileAttributes uint32
+	ReparseTag     uint32
+}
+
+const fileAttributeTagInfoClass = 9 // FileAttributeTagInfo
+
+const fileAttributePinned = 0x00080000
+
+// Reparse tags used by common cloud-sync clients (OneDrive, Dropbox, ...)
+// to mark "placeholder" files that aren't actually hydrated on disk; see
+// https://docs.microsoft.com/en-us/windows/win32/fileio/reparse-point-tags
+const (
+	reparseTagCloud     = 0x9000001A // IO_REPARSE_TAG_CLOUD
+	reparseTagCloudMask = 0x0000F000 // IO_REPARSE_TAG_CLOUD_1 ... _F differ only in these bits
+)
+
+func isCloudPlaceholderTag(tag uint32) bool {
+	return tag&^reparseTagCloudMask == reparseTagCloud
+}
+
+// EvalSymlinks walks name component by component from f.root, resolving
+// any symlink or junction encountered at *any* path component - not just
+// the final one - (up to maxSymlinkHops total, matching the kernel's own
+// limit) and refusing to ever leave f.root, the same way the kernel would
+// refuse a ".." that walks off the root of a chrooted path. Checking only
+// the final component would let a symlink or junction at an interior
+// directory (e.g. root/some-dir/evil-junction/sub/file, where evil-junction
+// points at C:\Windows) be transparently followed by the regular file
+// APIs without ever being noticed. The scanner must call this and use
+// its result - rather than handing name straight to Lstat/Open - for
+// that protection to actually apply.
+//
+// Unlike filepath.EvalSymlinks, it also recognizes cloud-placeholder
+// reparse points (OneDrive, Dropbox, ...) and reports them rather than
+// transparently following or hydrating them, so the caller (the scanner)
+// can skip hashing a file that isn't actually present on disk.
+func (f *BasicFilesystem) EvalSymlinks(name string) (string, error) {
+	rooted, err := f.rooted(name)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(f.root, rooted)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return f.root, nil
+	}
+
+	hops := 0
+	current := f.root
+	for _, comp := range strings.Split(rel, string(filepath.Separator)) {
+		current, err = f.resolveComponent(filepath.Join(current, comp), &hops)
+		if err != nil {
+			return "", err
+		}
+	}
+	return current, nil
+}
+
+// resolveComponent resolves path - which is assumed to already be
+// contained in f.root - following any chain of symlinks/junctions found
+// at path itself (not its parents, which the caller has already
+// resolved), and returns the final, real location of that single path
+// component. hops is shared across the whole walk so the kernel's
+// per-lookup hop limit is enforced across the entire name, not reset per
+// component.
+func (f *BasicFilesystem) resolveComponent(path string, hops *int) (string, error) {
+	for {
+		tag, attrs, err := getReparseTag(path)
+		if err != nil {
+			// ERROR_NOT_A_REPARSE_POINT and friends: nothing more to
+			// resolve, this is the final, real path for this component.
+			return path, nil
+		}
+
+		if isCloudPlaceholderTag(tag) {
+			if attrs&fileAttributePinned != 0 {
+				// Pinned: the user has asked for this file to always be
+				// kept hydrated locally, so it's safe to read through.
+				return path, nil
+			}
+			return "", fmt.Errorf("%s: cloud placeholder is not hydrated", path)
+		}
+
+		if tag != reparseTagSymlink && tag != reparseTagMountPoint {
+			// Some other, unrelated reparse point (e.g. a deduplicated
+			// file); treat it as a real file rather than erroring.
+			return path, nil
+		}
+
+		*hops++
+		if *hops > maxSymlinkHops {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", path)
+		}
+
+		target, err := f.ReadSymlink(strings.TrimPrefix(path, f.root))
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		target = filepath.Clean(target)
+
+		if !f.isWithinRoot(target) {
+			return "", fmt.Errorf("%s: reparse point escapes folder root", path)
+		}
+		// The target's parent directories may themselves be links or
+		// junctions; resolve them too, so none is followed unchecked.
+		if target != f.root {
+			rel, err := filepath.Rel(f.root, filepath.Dir(target))
+			if err != nil {
+				return "", err
+			}
+			parent := f.root
+			if rel != "." {
+				for _, comp := range strings.Split(rel, string(filepath.Separator)) {
+					if parent, err = f.resolveComponent(filepath.Join(parent, comp), hops); err != nil {
+						return "", err
+					}
+				}
+			}
+			target = filepath.Join(parent, filepath.Base(target))
+		}
+		path = target
+	}
+}
+
+// isWithinRoot reports whether target is f.root itself or a descendant
+// of it. See isPathWithinRoot for why this isn't just strings.HasPrefix.
+func (f *BasicFilesystem) isWithinRoot(target string) bool {
+	return isPathWithinRoot(f.root, target)
+}
+
+// isPathWithinRoot reports whether target is root itself or a descendant
+// of it. Plain strings.HasPrefix(target, root) is separator-unaware and
+// wrongly accepts a sibling directory whose name happens to extend
+// root's: e.g. root `C:\sync` would incorrectly contain `C:\syncEvil`.
+// Shared by BasicFilesystem.isWithinRoot and the USN watcher, which
+// doesn't hold a *BasicFilesystem to call the method on.
+func isPathWithinRoot(root, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// getReparseTag returns the reparse tag and file attributes for path,
+// without following the reparse point, using
+// GetFileInformationByHandleEx(FileAttributeTagInfo). It returns an error
+// for any path that isn't a reparse point at all.
+func getReparseTag(path string) (tag uint32, attrs uint32, err error) {
+	path = fixLongPath(path)
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	h, err := syscall.CreateFile(p, 0, 0, nil, syscall.OPEN_EXISTING,
+		fileFlagOpenReparsePoint|fileFlagBackupSemantics, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer syscall.CloseHandle(h)
+
+	var info fileAttributeTagInfo
+	if err := windows.GetFileInformationByHandleEx(windows.Handle(h), fileAttributeTagInfoClass,
+		(*byte)(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		return 0, 0, err
+	}
+	if info.FileAttributes&windows.FILE_ATTRIBUTE_REPARSE_POINT == 0 {
+		return 0, 0, fmt.Errorf("%s: not a reparse point", path)
+	}
+	return info.ReparseTag, info.FileAttributes, nil
+}
+
+// ReparseTag returns the reparse point tag for name (e.g.
+// reparseTagSymlink, reparseTagMountPoint, or a cloud-placeholder tag
+// such as OneDrive's or Dropbox's), without following it. It returns an
+// error if name isn't a reparse point at all, in which case callers
+// recording it for observability (see protocol.WindowsData.ReparseTag)
+// should just store 0.
+func (f *BasicFilesystem) ReparseTag(name string) (tag uint32, attrs uint32, err error) {
+	rooted, err := f.rooted(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	return getReparseTag(rooted)
+}
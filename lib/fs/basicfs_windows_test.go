@@ -0,0 +1,209 @@
+// Copyright (C) 2018 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestFixLongPath(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		// Relative paths are never touched.
+		{`foo\bar`, `foo\bar`},
+		// Short absolute paths are left alone.
+		{`C:\foo\bar`, `C:\foo\bar`},
+		// Already extended-length paths are left alone.
+		{`\\?\C:\foo\bar`, `\\?\C:\foo\bar`},
+		{`\??\C:\foo\bar`, `\??\C:\foo\bar`},
+	}
+	for _, tc := range cases {
+		if got := fixLongPath(tc.in); got != tc.want {
+			t.Errorf("fixLongPath(%q) == %q, want %q", tc.in, got, tc.want)
+		}
+	}
+
+	// A drive-letter path long enough to need the extended-length form
+	// gets the \\?\ prefix, with forward slashes normalized and any
+	// "." / ".." segments collapsed.
+	long := `C:\` + strings.Repeat(`longdirectoryname\`, 20) + `file.txt`
+	if got := fixLongPath(long); !strings.HasPrefix(got, `\\?\C:\`) {
+		t.Errorf("fixLongPath(%q) = %q, want \\\\?\\ prefix", long, got)
+	}
+	if got := fixLongPath(strings.Replace(long, `\`, "/", -1)); strings.Contains(got, "/") {
+		t.Errorf("fixLongPath did not normalize forward slashes: %q", got)
+	}
+
+	// A UNC path long enough to need the extended-length form gets the
+	// \\?\UNC\ prefix with the leading \\ stripped.
+	longUNC := `\\server\share\` + strings.Repeat(`longdirectoryname\`, 20) + `file.txt`
+	if got := fixLongPath(longUNC); !strings.HasPrefix(got, `\\?\UNC\server\share\`) {
+		t.Errorf("fixLongPath(%q) = %q, want \\\\?\\UNC\\ prefix", longUNC, got)
+	}
+}
+
+func TestLongPathEndToEnd(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "syncthing-longpath-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	fs := NewFilesystem(FilesystemTypeBasic, tmp)
+
+	// Build a deep tree whose full path exceeds 400 characters.
+	deep := "d"
+	for len(filepath.Join(tmp, deep)) < 400 {
+		deep = filepath.Join(deep, strings.Repeat("d", 32))
+	}
+
+	if err := fs.MkdirAll(deep, 0755); err != nil {
+		t.Fatalf("MkdirAll on long path failed: %v", err)
+	}
+
+	file := filepath.Join(deep, "file.txt")
+	fd, err := fs.Create(file)
+	if err != nil {
+		t.Fatalf("Create on long path failed: %v", err)
+	}
+	fd.Close()
+
+	if _, err := fs.Lstat(file); err != nil {
+		t.Fatalf("Lstat on long path failed: %v", err)
+	}
+
+	if err := fs.Hide(file); err != nil {
+		t.Fatalf("Hide on long path failed: %v", err)
+	}
+	attrs, err := fs.GetFileAttributes(file)
+	if err != nil {
+		t.Fatalf("GetFileAttributes on long path failed: %v", err)
+	}
+	if attrs&syscall.FILE_ATTRIBUTE_HIDDEN == 0 {
+		t.Error("expected file to be hidden")
+	}
+	if err := fs.Unhide(file); err != nil {
+		t.Fatalf("Unhide on long path failed: %v", err)
+	}
+}
+
+func TestWindowsSymlinks(t *testing.T) {
+	fs := NewFilesystem(FilesystemTypeBasic, "").(*BasicFilesystem)
+	if !fs.SymlinksSupported() {
+		t.Skip("symlinks not supported on this machine (not elevated, Developer Mode off)")
+	}
+
+	tmp, err := ioutil.TempDir("", "syncthing-symlink-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	fs = NewFilesystem(FilesystemTypeBasic, tmp).(*BasicFilesystem)
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "target.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.CreateSymlink("target.txt", "link.txt"); err != nil {
+		t.Fatalf("CreateSymlink failed: %v", err)
+	}
+
+	got, err := fs.ReadSymlink("link.txt")
+	if err != nil {
+		t.Fatalf("ReadSymlink failed: %v", err)
+	}
+	if got != "target.txt" {
+		t.Errorf("ReadSymlink returned %q, want %q", got, "target.txt")
+	}
+}
+
+func TestParseReparseTargetJunction(t *testing.T) {
+	// A synthetic MOUNT_POINT_REPARSE_BUFFER (junction): no Flags field,
+	// so the path buffer starts right after PrintNameLength, at offset 16.
+	substitute := utf16Encode(`\??\C:\real\target\`)
+	print := utf16Encode(`C:\real\target\`)
+
+	pathBuf := append(append([]byte{}, utf16Bytes(substitute)...), utf16Bytes(print)...)
+
+	buf := make([]byte, 16+len(pathBuf))
+	putUint32(buf[0:4], reparseTagMountPoint)
+	putUint16(buf[8:10], 0)                                    // SubstituteNameOffset
+	putUint16(buf[10:12], uint16(len(utf16Bytes(substitute)))) // SubstituteNameLength
+	putUint16(buf[12:14], uint16(len(utf16Bytes(substitute)))) // PrintNameOffset
+	putUint16(buf[14:16], uint16(len(utf16Bytes(print))))      // PrintNameLength
+	copy(buf[16:], pathBuf)
+
+	got, err := parseReparseTarget(buf)
+	if err != nil {
+		t.Fatalf("parseReparseTarget failed: %v", err)
+	}
+	if want := `C:\real\target\`; got != want {
+		t.Errorf("parseReparseTarget(junction) = %q, want %q", got, want)
+	}
+}
+
+func utf16Encode(s string) []uint16 {
+	out, err := syscall.UTF16FromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return out[:len(out)-1] // drop the implicit NUL terminator
+}
+
+func utf16Bytes(u []uint16) []byte {
+	b := make([]byte, 2*len(u))
+	for i, v := range u {
+		b[2*i] = byte(v)
+		b[2*i+1] = byte(v >> 8)
+	}
+	return b
+}
+
+func putUint16(b []byte, v uint16) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+}
+
+func putUint32(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+	b[3] = byte(v >> 24)
+}
+
+func TestIsWithinRoot(t *testing.T) {
+	f := &BasicFilesystem{root: `C:\sync`}
+
+	cases := []struct {
+		target string
+		want   bool
+	}{
+		{`C:\sync`, true},
+		{`C:\sync\sub\file.txt`, true},
+		// A sibling whose name happens to extend root's as a string must
+		// not be accepted just because strings.HasPrefix would match it.
+		{`C:\syncEvil`, false},
+		{`C:\syncEvil\file.txt`, false},
+		{`C:\other`, false},
+		{`C:\`, false},
+	}
+	for _, tc := range cases {
+		if got := f.isWithinRoot(tc.target); got != tc.want {
+			t.Errorf("isWithinRoot(%q) = %v, want %v", tc.target, got, tc.want)
+		}
+	}
+}
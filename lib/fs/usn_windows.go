@@ -0,0 +1,459 @@
+// Copyright (C) 2018 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package fs
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	fsctlQueryUSNJournal = 0x000900F4
+	fsctlReadUSNJournal  = 0x000900BB
+	fsctlEnumUSNData     = 0x000900B3
+
+	usnReasonRenameNewName = 0x00002000
+	usnReasonFileCreate    = 0x00000100
+
+	usnPageSize = 64 * 1024
+)
+
+// usnJournalID holds the identity of a volume's change journal, as
+// returned by FSCTL_QUERY_USN_JOURNAL (USN_JOURNAL_DATA_V0). A journal
+// that's been deleted and recreated (e.g. by disabling and re-enabling it,
+// or reformatting) gets a new ID, which we use to detect that our recorded
+// UsnState is stale.
+type usnJournalID struct {
+	JournalID       uint64
+	FirstUSN        int64
+	NextUSN         int64
+	LowestValidUSN  int64
+	MaxUSN          int64
+	MaximumSize     uint64
+	AllocationDelta uint64
+}
+
+// USNState is the bit of per-folder state that needs to survive a restart
+// for the USN watcher to resume from where it left off, rather than
+// replaying or missing history. The store WatchUSN uses is fileUSNState,
+// which keeps it in a small file per folder root rather than in the index
+// database; this interface is the seam for any other store.
+type USNState interface {
+	// LastUSN returns the last processed USN and journal ID for root, or
+	// ok=false if nothing has been recorded yet.
+	LastUSN(root string) (journalID uint64, usn int64, ok bool)
+	// SetLastUSN records the last processed USN and journal ID for root.
+	SetLastUSN(root string, journalID uint64, usn int64)
+}
+
+// usnWatcher watches a single NTFS volume's change journal for changes
+// under a folder root, and emits fs.Events equivalent to the regular
+// ReadDirectoryChangesW-based watcher, but without losing events across
+// buffer overflows or process restarts.
+type usnWatcher struct {
+	root   string // folder root, absolute, as returned by BasicFilesystem.rooted("")
+	volume string // e.g. `\\.\C:`
+	state  USNState
+
+	handle windows.Handle
+
+	mut       sync.Mutex
+	frnToPath map[uint64]string // FileReferenceNumber -> path cache, refreshed lazily
+}
+
+// newUSNWatcher opens root's volume and confirms it's NTFS (the USN
+// journal is an NTFS-only feature); GetVolumeInformation is used as the
+// probe rather than attempting FSCTL_QUERY_USN_JOURNAL and inspecting the
+// error, so that non-NTFS volumes fail fast with a clear message.
+func newUSNWatcher(root string, state USNState) (*usnWatcher, error) {
+	vol := filepath.VolumeName(root)
+	if vol == "" {
+		return nil, fmt.Errorf("usn: %s has no volume name", root)
+	}
+
+	volp, err := syscall.UTF16PtrFromString(vol + `\`)
+	if err != nil {
+		return nil, err
+	}
+	var fsFlags uint32
+	fsName := make([]uint16, 32)
+	if err := windows.GetVolumeInformation(volp, nil, 0, nil, nil, &fsFlags, &fsName[0], uint32(len(fsName))); err != nil {
+		return nil, fmt.Errorf("usn: querying volume information for %s: %w", vol, err)
+	}
+	if syscall.UTF16ToString(fsName) != "NTFS" {
+		return nil, fmt.Errorf("usn: %s is not an NTFS volume, USN journal unavailable", vol)
+	}
+
+	devicePath := `\\.\` + vol
+	devicePathp, err := syscall.UTF16PtrFromString(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(devicePathp, syscall.GENERIC_READ, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
+		nil, syscall.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("usn: opening volume %s: %w", devicePath, err)
+	}
+
+	return &usnWatcher{
+		root:      root,
+		volume:    devicePath,
+		state:     state,
+		handle:    windows.Handle(h),
+		frnToPath: make(map[uint64]string),
+	}, nil
+}
+
+func (w *usnWatcher) Close() error {
+	return windows.CloseHandle(w.handle)
+}
+
+func (w *usnWatcher) queryJournal() (usnJournalID, error) {
+	var id usnJournalID
+	var bytesReturned uint32
+	err := windows.DeviceIoControl(w.handle, fsctlQueryUSNJournal, nil, 0,
+		(*byte)(unsafe.Pointer(&id)), uint32(unsafe.Sizeof(id)), &bytesReturned, nil)
+	return id, err
+}
+
+// Watch replays USN records since the last recorded position (or starts
+// from the journal's current end if this is the first run on this
+// journal), and emits one fs.Event per change under w.root, until stop is
+// closed. A journal wrap or ID mismatch against the recorded state causes
+// fullRescan to be invoked instead of replaying, since at that point we
+// can no longer trust the journal to describe everything that happened.
+func (w *usnWatcher) Watch(stop <-chan struct{}, events chan<- Event, fullRescan func()) error {
+	journal, err := w.queryJournal()
+	if err != nil {
+		return err
+	}
+
+	startUSN := journal.NextUSN
+	if lastJournalID, lastUSN, ok := w.state.LastUSN(w.root); ok {
+		if lastJournalID != journal.JournalID {
+			// The journal was recreated since we last looked; there's no
+			// way to tell what we missed in between.
+			fullRescan()
+		} else if lastUSN < journal.FirstUSN {
+			// The journal has wrapped: the records since lastUSN have been
+			// purged, so there's no way to tell what we missed either.
+			fullRescan()
+		} else {
+			startUSN = lastUSN
+		}
+	} else {
+		// First time watching this root: nothing to replay, start from
+		// the current end of the journal.
+		fullRescan()
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		recs, nextUSN, err := w.readJournal(journal.JournalID, startUSN)
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			if rec.reason&(usnReasonRenameNewName|usnReasonFileCreate) != 0 {
+				// The FRN cache entry for this file (if any) is now
+				// stale; it'll be rebuilt lazily from the parent FRN on
+				// next lookup.
+				w.mut.Lock()
+				delete(w.frnToPath, rec.frn)
+				w.mut.Unlock()
+			}
+			path, err := w.pathForFRN(rec.frn, rec.parentFRN, rec.name)
+			if err != nil {
+				// The file may have been deleted again already; skip it
+				// rather than fail the whole batch.
+				continue
+			}
+			if !isPathWithinRoot(w.root, path) {
+				continue
+			}
+			rel, err := filepath.Rel(w.root, path)
+			if err != nil {
+				continue
+			}
+			select {
+			case events <- Event{Name: rel, Type: NonRemove}:
+			case <-stop:
+				return nil
+			}
+		}
+
+		w.state.SetLastUSN(w.root, journal.JournalID, nextUSN)
+		startUSN = nextUSN
+	}
+}
+
+type usnRecord struct {
+	frn, parentFRN uint64
+	reason         uint32
+	name           string
+}
+
+// readJournal reads one page of USN records starting at usn and returns
+// them along with the USN to resume from. Splitting into pages (rather
+// than reading the whole delta at once) keeps memory bounded on volumes
+// with very large journals.
+func (w *usnWatcher) readJournal(journalID uint64, usn int64) ([]usnRecord, int64, error) {
+	type readJournalData struct {
+		StartUSN          int64
+		ReasonMask        uint32
+		ReturnOnlyOnClose uint32
+		Timeout           uint64
+		BytesToWaitFor    uint64
+		UsnJournalID      uint64
+	}
+	in := readJournalData{
+		StartUSN:   usn,
+		ReasonMask: 0xFFFFFFFF,
+		// BytesToWaitFor > 0 makes FSCTL_READ_USN_JOURNAL a blocking call:
+		// it waits for at least one byte of new journal data rather than
+		// returning immediately with zero records, so Watch's loop doesn't
+		// busy-spin re-issuing the ioctl once it's caught up to the end of
+		// the journal.
+		BytesToWaitFor: 1,
+		UsnJournalID:   journalID,
+	}
+
+	buf := make([]byte, usnPageSize)
+	var bytesReturned uint32
+	err := windows.DeviceIoControl(w.handle, fsctlReadUSNJournal,
+		(*byte)(unsafe.Pointer(&in)), uint32(unsafe.Sizeof(in)),
+		&buf[0], uint32(len(buf)), &bytesReturned, nil)
+	if err != nil {
+		return nil, usn, err
+	}
+	if bytesReturned < 8 {
+		return nil, usn, nil
+	}
+
+	nextUSN := int64(readUint64(buf[0:8]))
+	recs := parseUSNRecords(buf[8:bytesReturned])
+	return recs, nextUSN, nil
+}
+
+// pathForFRN resolves a file reference number to an absolute path, using
+// the cache built by FSCTL_ENUM_USN_DATA, which holds only paths whose
+// parent chain leads up to w.root; on a miss the whole cache is rebuilt.
+func (w *usnWatcher) pathForFRN(frn, parentFRN uint64, name string) (string, error) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if parentPath, ok := w.frnToPath[parentFRN]; ok {
+		path := filepath.Join(parentPath, name)
+		w.frnToPath[frn] = path
+		return path, nil
+	}
+
+	if err := w.rebuildFRNCacheLocked(); err != nil {
+		return "", err
+	}
+	if parentPath, ok := w.frnToPath[parentFRN]; ok {
+		path := filepath.Join(parentPath, name)
+		w.frnToPath[frn] = path
+		return path, nil
+	}
+	return "", fmt.Errorf("usn: no path known for parent FRN %d", parentFRN)
+}
+
+// mftEntry is one raw (parent FRN, name) pair collected from the
+// FSCTL_ENUM_USN_DATA pass, before paths have been joined together.
+type mftEntry struct {
+	parentFRN uint64
+	name      string
+}
+
+// rebuildFRNCacheLocked walks the volume's full FRN->name/parent mapping
+// via FSCTL_ENUM_USN_DATA and reconstructs full paths for every entry,
+// anchored at w.root. It's O(files on volume) and called lazily, each
+// time a lookup misses (including lookups for changes outside w.root),
+// rather than kept up to date incrementally.
+func (w *usnWatcher) rebuildFRNCacheLocked() error {
+	rootFRN, err := frnOf(w.root)
+	if err != nil {
+		return fmt.Errorf("usn: resolving FRN of %s: %w", w.root, err)
+	}
+
+	entries, err := w.enumMFT()
+	if err != nil {
+		return fmt.Errorf("usn: enumerating MFT: %w", err)
+	}
+
+	w.frnToPath = map[uint64]string{rootFRN: w.root}
+	for frn := range entries {
+		if _, err := w.resolvePathLocked(frn, entries, 0); err != nil {
+			// Orphaned or outside-root entries are expected (most of the
+			// volume isn't under w.root); skip them rather than fail the
+			// whole rebuild.
+			continue
+		}
+	}
+	return nil
+}
+
+// resolvePathLocked computes and memoizes the full path of frn, walking
+// up the parent chain through entries until it hits an already-resolved
+// ancestor (typically the root anchor seeded by rebuildFRNCacheLocked).
+// depth guards against a corrupt or cyclic parent chain.
+func (w *usnWatcher) resolvePathLocked(frn uint64, entries map[uint64]mftEntry, depth int) (string, error) {
+	if path, ok := w.frnToPath[frn]; ok {
+		return path, nil
+	}
+	if depth > 4096 {
+		return "", fmt.Errorf("usn: parent chain too deep or cyclic at FRN %d", frn)
+	}
+
+	entry, ok := entries[frn]
+	if !ok {
+		return "", fmt.Errorf("usn: no MFT entry for FRN %d", frn)
+	}
+
+	parentPath, err := w.resolvePathLocked(entry.parentFRN, entries, depth+1)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(parentPath, entry.name)
+	w.frnToPath[frn] = path
+	return path, nil
+}
+
+// enumMFT performs a full FSCTL_ENUM_USN_DATA pass over the volume,
+// returning the raw (FRN -> parent FRN, name) mapping for every file and
+// directory record in the Master File Table. The volume as a whole is
+// enumerated (rather than just the subtree under w.root) because
+// FSCTL_ENUM_USN_DATA walks the MFT in FRN order, not directory order, so
+// there's no way to restrict it to a subtree up front.
+func (w *usnWatcher) enumMFT() (map[uint64]mftEntry, error) {
+	type mftEnumData struct {
+		StartFileReferenceNumber uint64
+		LowUsn                   int64
+		HighUsn                  int64
+	}
+
+	entries := make(map[uint64]mftEntry)
+	in := mftEnumData{HighUsn: 1<<63 - 1}
+	buf := make([]byte, usnPageSize)
+
+	for {
+		var bytesReturned uint32
+		err := windows.DeviceIoControl(w.handle, fsctlEnumUSNData,
+			(*byte)(unsafe.Pointer(&in)), uint32(unsafe.Sizeof(in)),
+			&buf[0], uint32(len(buf)), &bytesReturned, nil)
+		if err == windows.ERROR_HANDLE_EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if bytesReturned < 8 {
+			break
+		}
+
+		nextFRN := readUint64(buf[0:8])
+		for _, rec := range parseUSNRecords(buf[8:bytesReturned]) {
+			entries[rec.frn] = mftEntry{parentFRN: rec.parentFRN, name: rec.name}
+		}
+
+		if nextFRN <= in.StartFileReferenceNumber {
+			// No forward progress; avoid spinning forever on an
+			// unexpected reply.
+			break
+		}
+		in.StartFileReferenceNumber = nextFRN
+	}
+
+	return entries, nil
+}
+
+// frnOf returns the file reference number identifying path on its
+// volume, used to anchor the FRN->path cache at a known-good path (w.root)
+// without having to enumerate the whole volume just to find it.
+func frnOf(path string) (uint64, error) {
+	path = fixLongPath(path)
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	h, err := syscall.CreateFile(p, syscall.GENERIC_READ,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING, fileFlagBackupSemantics, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.CloseHandle(h)
+
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(h, &info); err != nil {
+		return 0, err
+	}
+	return uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow), nil
+}
+
+func readUint64(b []byte) uint64 {
+	var v uint64
+	for i := 7; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+// parseUSNRecords walks a buffer of consecutive USN_RECORD_V2 structures
+// as returned by FSCTL_READ_USN_JOURNAL.
+func parseUSNRecords(buf []byte) []usnRecord {
+	type usnRecordHeader struct {
+		RecordLength   uint32
+		MajorVersion   uint16
+		MinorVersion   uint16
+		FileRefNum     uint64
+		ParentRefNum   uint64
+		USN            int64
+		Timestamp      int64
+		Reason         uint32
+		SourceInfo     uint32
+		SecurityID     uint32
+		FileAttributes uint32
+		FileNameLength uint16
+		FileNameOffset uint16
+	}
+
+	var out []usnRecord
+	for len(buf) >= int(unsafe.Sizeof(usnRecordHeader{})) {
+		hdr := (*usnRecordHeader)(unsafe.Pointer(&buf[0]))
+		if hdr.RecordLength == 0 || int(hdr.RecordLength) > len(buf) {
+			break
+		}
+		nameBytes := buf[hdr.FileNameOffset : hdr.FileNameOffset+hdr.FileNameLength]
+		u16 := make([]uint16, len(nameBytes)/2)
+		for i := range u16 {
+			u16[i] = uint16(nameBytes[2*i]) | uint16(nameBytes[2*i+1])<<8
+		}
+		out = append(out, usnRecord{
+			frn:       hdr.FileRefNum,
+			parentFRN: hdr.ParentRefNum,
+			reason:    hdr.Reason,
+			name:      syscall.UTF16ToString(u16),
+		})
+		buf = buf[hdr.RecordLength:]
+	}
+	return out
+}
@@ -0,0 +1,30 @@
+// Copyright (C) 2018 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package model
+
+import (
+	"context"
+
+	"github.com/syncthing/syncthing/lib/fs"
+)
+
+// startWatch is the folder-level entry point for the filesystem watcher
+// on Windows: it tries BasicFilesystem.WatchUSN first, so a folder on an
+// NTFS volume catches up on changes made while Syncthing wasn't running,
+// and falls back to the regular ReadDirectoryChangesW-based fs.Watch when
+// WatchUSN can't be used (not NTFS, or its state store couldn't be
+// opened) rather than leaving the folder unwatched.
+func startWatch(ctx context.Context, filesystem fs.Filesystem, stateDir string) (<-chan fs.Event, <-chan error, error) {
+	if bfs, ok := filesystem.(*fs.BasicFilesystem); ok {
+		if events, errs, err := bfs.WatchUSN(ctx, stateDir); err == nil {
+			return events, errs, nil
+		}
+	}
+	return filesystem.Watch(".", nil, ctx, false)
+}
@@ -0,0 +1,27 @@
+// Copyright (C) 2018 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package model
+
+import (
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/fs"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// FinishPull is called once the puller has written a file's contents and
+// is about to mark it done. When the folder has syncWindowsAttributes
+// enabled, it reapplies the sending device's recorded Windows attributes,
+// so a HIDDEN or READONLY file comes back HIDDEN or READONLY here too
+// instead of just matching on bytes.
+func FinishPull(filesystem fs.Filesystem, folderCfg config.FolderConfiguration, name string, fi protocol.FileInfo) error {
+	if !folderCfg.SyncWindowsAttributes {
+		return nil
+	}
+	return applyWindowsPlatformData(filesystem, name, fi.Platform.Windows)
+}
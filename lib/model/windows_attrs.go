@@ -0,0 +1,49 @@
+// Copyright (C) 2018 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package model
+
+import (
+	"github.com/syncthing/syncthing/lib/fs"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// applyWindowsPlatformData reapplies the Windows file attributes recorded
+// on wd to name, after the puller has finished writing its contents, so
+// that a HIDDEN or READONLY file stays HIDDEN/READONLY on this replica
+// too. It's a no-op when wd is nil or its Attributes is 0 (the sending
+// device didn't record attributes, e.g. because syncWindowsAttributes was
+// off there, or it wasn't a Windows device at all; recorded attributes
+// always have at least one bit set, FILE_ATTRIBUTE_NORMAL if nothing
+// else) or the local filesystem isn't a *fs.BasicFilesystem.
+func applyWindowsPlatformData(filesystem fs.Filesystem, name string, wd *protocol.WindowsData) error {
+	if wd == nil || wd.Attributes == 0 {
+		return nil
+	}
+	bfs, ok := filesystem.(*fs.BasicFilesystem)
+	if !ok {
+		return nil
+	}
+
+	current, err := bfs.GetFileAttributes(name)
+	if err != nil {
+		return err
+	}
+
+	if toAdd := wd.Attributes &^ current; toAdd != 0 {
+		if err := bfs.AddFileAttributes(name, toAdd); err != nil {
+			return err
+		}
+	}
+	if toRemove := current &^ wd.Attributes; toRemove != 0 {
+		if err := bfs.RemoveFileAttributes(name, toRemove); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package protocol
+
+// FileInfo is the metadata Syncthing tracks for a single file or
+// directory and exchanges with other devices on the wire. In the full
+// repository this is generated from bep.proto into bep.pb.go, along with
+// the rest of the BEP message set; that generated file isn't part of
+// this tree, so this is the subset the scanner and puller need to carry
+// Platform-specific metadata (see PlatformData) end to end.
+type FileInfo struct {
+	Name      string
+	Size      int64
+	ModifiedS int64
+	Deleted   bool
+
+	Platform PlatformData
+}
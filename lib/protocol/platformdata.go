@@ -0,0 +1,31 @@
+// Copyright (C) 2018 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package protocol
+
+// PlatformData holds metadata that only makes sense on a specific
+// platform, carried on FileInfo.Platform so it round-trips between
+// devices even when the receiving device doesn't run that platform: a
+// Linux device receiving a file from Windows keeps WindowsData around
+// unexamined, and gives it back unchanged if it later sends that file on
+// to another Windows device.
+type PlatformData struct {
+	Windows *WindowsData
+}
+
+// WindowsData is the Windows-specific subset of PlatformData: the file
+// attribute bits (READONLY, HIDDEN, SYSTEM, ARCHIVE, TEMPORARY, OFFLINE,
+// NOT_CONTENT_INDEXED) recorded by the scanner and reapplied by the
+// puller when syncWindowsAttributes is enabled for the folder, plus the
+// reparse point tag observed at scan time (0 if none). ReparseTag is
+// recorded unconditionally, independent of syncWindowsAttributes: it's
+// pure observability - e.g. telling a cloud placeholder apart from a
+// regular file in `syncthing show` output - not something that's synced
+// or reapplied to another replica.
+type WindowsData struct {
+	Attributes uint32
+	ReparseTag uint32
+}
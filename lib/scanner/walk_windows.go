@@ -0,0 +1,52 @@
+// Copyright (C) 2018 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package scanner
+
+import (
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/fs"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// ScanFile is what the folder walk calls per entry on Windows: it
+// resolves name through BasicFilesystem.EvalSymlinks before stat'ing it,
+// so a reparse point that escapes the folder root (a malicious junction
+// pointing at C:\Windows) or an unhydrated cloud placeholder is rejected
+// here rather than silently traversed or force-downloaded just to hash
+// it, and builds the protocol.FileInfo to record for it, including
+// Platform.Windows when the folder has it to give.
+func ScanFile(filesystem fs.Filesystem, folderCfg config.FolderConfiguration, name string) (protocol.FileInfo, error) {
+	resolved := name
+	if bfs, ok := filesystem.(*fs.BasicFilesystem); ok {
+		r, err := bfs.EvalSymlinks(name)
+		if err != nil {
+			return protocol.FileInfo{}, err
+		}
+		resolved = r
+	}
+
+	info, err := filesystem.Lstat(resolved)
+	if err != nil {
+		return protocol.FileInfo{}, err
+	}
+
+	fi := protocol.FileInfo{
+		Name:      name,
+		Size:      info.Size(),
+		ModifiedS: info.ModTime().Unix(),
+	}
+
+	wd, err := windowsPlatformData(filesystem, name, folderCfg.SyncWindowsAttributes)
+	if err != nil {
+		return protocol.FileInfo{}, err
+	}
+	fi.Platform.Windows = &wd
+
+	return fi, nil
+}
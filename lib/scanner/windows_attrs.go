@@ -0,0 +1,43 @@
+// Copyright (C) 2018 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package scanner
+
+import (
+	"github.com/syncthing/syncthing/lib/fs"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// windowsPlatformData builds the protocol.WindowsData to store on a
+// FileInfo's Platform.Windows while scanning name. Attributes is only
+// populated for folders with syncWindowsAttributes enabled, since it's
+// synced and reapplied on other replicas; ReparseTag is recorded
+// unconditionally, since it's pure observability (see
+// protocol.WindowsData).
+func windowsPlatformData(filesystem fs.Filesystem, name string, syncAttrs bool) (protocol.WindowsData, error) {
+	bfs, ok := filesystem.(*fs.BasicFilesystem)
+	if !ok {
+		return protocol.WindowsData{}, nil
+	}
+
+	var wd protocol.WindowsData
+
+	if syncAttrs {
+		attrs, err := bfs.GetFileAttributes(name)
+		if err != nil {
+			return protocol.WindowsData{}, err
+		}
+		wd.Attributes = attrs
+	}
+
+	if tag, _, err := bfs.ReparseTag(name); err == nil {
+		wd.ReparseTag = tag
+	}
+
+	return wd, nil
+}